@@ -0,0 +1,186 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tally
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ContextCloser is implemented by the io.Closer returned alongside a root
+// Scope from NewRootScope, letting callers bound the final flush with
+// CloseWithContext instead of the unbounded Close.
+type ContextCloser interface {
+	io.Closer
+
+	// CloseWithContext is Close, bounded by ctx instead of
+	// ScopeOptions.CloseTimeout.
+	CloseWithContext(ctx context.Context) error
+}
+
+// FlushWithError is an optional extension to BaseStatsReporter,
+// feature-detected via a type assertion in CloseWithContext, for reporters
+// that can report whether their final Flush succeeded. Reporters that only
+// implement Flush() are still called, but any error is unobservable.
+type FlushWithError interface {
+	FlushWithError() error
+}
+
+// CloseWithContext closes the scope, bounding how long the final flush may
+// take by ctx. If ctx is cancelled or its deadline expires before the flush
+// finishes, CloseWithContext returns without waiting for it further. If the
+// flush finishes in time, the returned error, if any, combines the
+// reporter's flush error (if it implements FlushWithError) and any error
+// closing the underlying reporter. If it doesn't, the returned error
+// combines a deadline-exceeded error and the number of
+// counters/gauges/histograms still buffered at that point; the reporter is
+// then closed once the flush finishes, and any flush or close error from
+// that point is discarded.
+//
+// Close is equivalent to CloseWithContext bounded by ScopeOptions.CloseTimeout
+// (or unbounded if unset), and remains the right choice unless a caller needs
+// to supply its own deadline, e.g. a signal handler with a fixed shutdown
+// budget.
+func (s *scope) CloseWithContext(ctx context.Context) error {
+	s.status.Lock()
+	defer s.status.Unlock()
+
+	// don't wait to close more than once (panic on double close of
+	// s.status.quit)
+	if s.status.closed {
+		return nil
+	}
+
+	s.status.closed = true
+	close(s.status.quit)
+
+	var errs []error
+
+	flushDone := make(chan error, 1)
+	go func() {
+		flushDone <- s.flushWithError()
+	}()
+
+	closeReporter := func() error {
+		if closer, ok := s.baseReporter.(io.Closer); ok {
+			return closer.Close()
+		}
+		return nil
+	}
+
+	select {
+	case err := <-flushDone:
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if err := closeReporter(); err != nil {
+			errs = append(errs, err)
+		}
+	case <-ctx.Done():
+		errs = append(errs,
+			fmt.Errorf("tally: final flush did not complete before close deadline: %w", ctx.Err()),
+			s.bufferedMetricsError(),
+		)
+
+		// The flush goroutine above is still in there calling into
+		// s.baseReporter; closing it out from under that call (e.g. an
+		// in-flight otlp.Reporter.Export racing conn.Close) is exactly the
+		// overlap the old synchronous Close() prevented. Let it finish on
+		// its own and close once it does, rather than joining here and
+		// blowing past the deadline we were just asked to respect. Any
+		// error closing the reporter at that point has nowhere left to go.
+		go func() {
+			<-flushDone
+			_ = closeReporter()
+		}()
+	}
+
+	return multiErr(errs)
+}
+
+// flushWithError runs the scope's final report and flush, surfacing a
+// FlushWithError error if the reporter supports it.
+func (s *scope) flushWithError() error {
+	if s.reporter != nil {
+		s.registry.Report(s.reporter)
+		return flushBaseReporter(s.reporter)
+	} else if s.cachedReporter != nil {
+		s.registry.CachedReport()
+		return flushBaseReporter(s.cachedReporter)
+	}
+	return nil
+}
+
+func flushBaseReporter(r BaseStatsReporter) error {
+	if fe, ok := r.(FlushWithError); ok {
+		return fe.FlushWithError()
+	}
+	r.Flush()
+	return nil
+}
+
+// bufferedMetricsError reports how many counters, gauges and histograms
+// were still registered on the scope when a CloseWithContext deadline was
+// exceeded, to help diagnose what a truncated flush may have dropped.
+func (s *scope) bufferedMetricsError() error {
+	return fmt.Errorf(
+		"tally: %d counters, %d gauges and %d histograms were still buffered",
+		s.counters.count(), s.gauges.count(), s.histograms.count(),
+	)
+}
+
+// multiError joins multiple non-nil errors into one.
+type multiError struct {
+	errs []error
+}
+
+func multiErr(errs []error) error {
+	var nonNil []error
+	for _, err := range errs {
+		if err != nil {
+			nonNil = append(nonNil, err)
+		}
+	}
+
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		return nonNil[0]
+	default:
+		return &multiError{errs: nonNil}
+	}
+}
+
+func (m *multiError) Error() string {
+	msgs := make([]string, 0, len(m.errs))
+	for _, err := range m.errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap allows errors.Is/errors.As to reach any of the joined errors.
+func (m *multiError) Unwrap() []error {
+	return m.errs
+}
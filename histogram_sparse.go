@@ -0,0 +1,343 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tally
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	_minExponentialSchema = -4
+	_maxExponentialSchema = 8
+)
+
+// ExponentialBuckets configures a histogram whose buckets are not
+// pre-declared but derived on the fly from each observed value, modeled on
+// Prometheus's native histograms. Use it when the expected range of a
+// latency distribution isn't known up front.
+//
+// Buckets are indexed by ⌊log_base(v)⌋ where base = 2^(2^-Schema); Schema
+// must be in [-4, 8], with higher values giving finer-grained buckets.
+// MaxBuckets bounds how many positive+negative indexes may be populated at
+// once; once exceeded, resolution is halved (Schema is decremented and
+// adjacent indexes are merged) until the bound is satisfied again or Schema
+// reaches -4, below which no further halving is done.
+type ExponentialBuckets struct {
+	Schema     int8
+	MaxBuckets int
+
+	// ZeroThreshold is the absolute value at or below which an observation is
+	// counted in the zero bucket instead of a positive/negative bucket,
+	// absorbing values that would otherwise need arbitrarily negative
+	// indexes to represent. Defaults to 0, counting only exact zeroes.
+	ZeroThreshold float64
+}
+
+// Len implements Buckets. It reports the configured bucket budget rather
+// than a current bucket count, since the actual set of populated buckets
+// changes with every observation.
+func (b ExponentialBuckets) Len() int {
+	return b.MaxBuckets
+}
+
+// String implements Buckets.
+func (b ExponentialBuckets) String() string {
+	return fmt.Sprintf("exponential(schema=%d,maxBuckets=%d)", b.Schema, b.MaxBuckets)
+}
+
+// CachedSparseHistogram is the cached handle for a sparse/exponential
+// histogram, allocated by an optional CachedStatsReporter extension. See
+// SparseHistogramReporter.
+type CachedSparseHistogram interface {
+	// ReportSparseHistogram reports the current state of a sparse
+	// histogram: its schema, zero bucket, running sum/count, and the
+	// populated positive/negative buckets keyed by index.
+	ReportSparseHistogram(
+		schema int8,
+		zeroCount uint64,
+		zeroThreshold float64,
+		sum float64,
+		count int64,
+		positive, negative map[int]uint64,
+	)
+}
+
+// SparseHistogramReporter is an optional extension to CachedStatsReporter,
+// feature-detected via a type assertion in scope.Histogram, implemented by
+// reporters that understand native exponential histograms (e.g. an OTel
+// collector or a Prometheus native-histogram remote-write target).
+// Reporters that don't implement it keep compiling unchanged; sparse
+// histograms allocated against them are simply never cache-reported.
+type SparseHistogramReporter interface {
+	AllocateSparseHistogram(name string, tags map[string]string) CachedSparseHistogram
+}
+
+// reportableHistogram is implemented by both the dense *histogram and the
+// sparse *sparseHistogram, so the scope can report, cache-report and
+// snapshot either kind through a single registry without caring which one
+// it's holding.
+type reportableHistogram interface {
+	Histogram
+
+	report(fullyQualifiedName string, tags map[string]string, r StatsReporter)
+	cachedReport()
+	snapshotValues() map[float64]int64
+	snapshotDurations() map[time.Duration]int64
+}
+
+// sparseHistogram is a Histogram backed by ExponentialBuckets.
+type sparseHistogram struct {
+	mu sync.Mutex
+
+	name     string
+	tags     map[string]string
+	reporter StatsReporter
+	cached   CachedSparseHistogram
+
+	schema        int8
+	maxBuckets    int
+	zeroThreshold float64
+
+	positive  map[int]uint64
+	negative  map[int]uint64
+	zeroCount uint64
+	sum       float64
+	count     uint64
+}
+
+func newSparseHistogram(
+	name string,
+	tags map[string]string,
+	r StatsReporter,
+	cached CachedSparseHistogram,
+	buckets ExponentialBuckets,
+) *sparseHistogram {
+	return &sparseHistogram{
+		name:          name,
+		tags:          tags,
+		reporter:      r,
+		cached:        cached,
+		schema:        buckets.Schema,
+		maxBuckets:    buckets.MaxBuckets,
+		zeroThreshold: buckets.ZeroThreshold,
+		positive:      make(map[int]uint64),
+		negative:      make(map[int]uint64),
+	}
+}
+
+// RecordValue implements Histogram.
+func (h *sparseHistogram) RecordValue(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count++
+	h.sum += value
+
+	abs := math.Abs(value)
+	if abs <= h.zeroThreshold {
+		h.zeroCount++
+		return
+	}
+
+	bucket := h.positive
+	if value < 0 {
+		bucket = h.negative
+	}
+	bucket[h.indexOfLocked(abs)]++
+	h.rescaleLocked()
+}
+
+// RecordDuration implements Histogram.
+func (h *sparseHistogram) RecordDuration(value time.Duration) {
+	h.RecordValue(value.Seconds())
+}
+
+// Start implements Histogram, timing a block of code and recording its
+// elapsed duration when the returned Stopwatch is stopped.
+func (h *sparseHistogram) Start() Stopwatch {
+	return NewStopwatch(globalNow(), h)
+}
+
+// RecordStopwatch implements StopwatchRecorder.
+func (h *sparseHistogram) RecordStopwatch(stopwatchStart time.Time) {
+	h.RecordDuration(globalNow().Sub(stopwatchStart))
+}
+
+func (h *sparseHistogram) base() float64 {
+	return math.Pow(2, math.Pow(2, -float64(h.schema)))
+}
+
+func (h *sparseHistogram) indexOfLocked(absValue float64) int {
+	return int(math.Floor(math.Log(absValue) / math.Log(h.base())))
+}
+
+// rescaleLocked halves the histogram's resolution until the number of
+// populated buckets is back within maxBuckets, merging index i and i+1 into
+// ⌊i/2⌋ each time, as described by the request.
+func (h *sparseHistogram) rescaleLocked() {
+	for len(h.positive)+len(h.negative) > h.maxBuckets && h.schema > _minExponentialSchema {
+		h.positive = rescaleBuckets(h.positive)
+		h.negative = rescaleBuckets(h.negative)
+		h.schema--
+	}
+}
+
+func rescaleBuckets(buckets map[int]uint64) map[int]uint64 {
+	rescaled := make(map[int]uint64, len(buckets))
+	for idx, count := range buckets {
+		rescaled[floorDiv(idx, 2)] += count
+	}
+	return rescaled
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// report implements reportableHistogram, reconstructing bucket boundaries
+// from each populated index's base^index and reporting samples through the
+// regular push StatsReporter interface.
+func (h *sparseHistogram) report(fullyQualifiedName string, tags map[string]string, r StatsReporter) {
+	h.mu.Lock()
+	base := h.base()
+	positive := copyUint64Map(h.positive)
+	negative := copyUint64Map(h.negative)
+	h.mu.Unlock()
+
+	for idx, count := range positive {
+		lower, upper := math.Pow(base, float64(idx)), math.Pow(base, float64(idx+1))
+		r.ReportHistogramValueSamples(fullyQualifiedName, tags, nil, lower, upper, int64(count))
+	}
+	for idx, count := range negative {
+		lower, upper := -math.Pow(base, float64(idx+1)), -math.Pow(base, float64(idx))
+		r.ReportHistogramValueSamples(fullyQualifiedName, tags, nil, lower, upper, int64(count))
+	}
+}
+
+// cachedReport implements reportableHistogram.
+func (h *sparseHistogram) cachedReport() {
+	if h.cached == nil {
+		return
+	}
+
+	h.mu.Lock()
+	schema, zeroCount, zeroThreshold := h.schema, h.zeroCount, h.zeroThreshold
+	sum, count := h.sum, int64(h.count)
+	positive, negative := copyUint64Map(h.positive), copyUint64Map(h.negative)
+	h.mu.Unlock()
+
+	h.cached.ReportSparseHistogram(schema, zeroCount, zeroThreshold, sum, count, positive, negative)
+}
+
+// snapshotValues implements reportableHistogram, keyed by each populated
+// bucket's upper bound: base^(index+1) for a positive bucket, -base^index
+// for a negative one.
+func (h *sparseHistogram) snapshotValues() map[float64]int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	base := h.base()
+	values := make(map[float64]int64, len(h.positive)+len(h.negative))
+	for idx, count := range h.positive {
+		values[math.Pow(base, float64(idx+1))] = int64(count)
+	}
+	for idx, count := range h.negative {
+		values[-math.Pow(base, float64(idx))] = int64(count)
+	}
+	return values
+}
+
+// snapshotDurations implements reportableHistogram.
+func (h *sparseHistogram) snapshotDurations() map[time.Duration]int64 {
+	values := h.snapshotValues()
+	durations := make(map[time.Duration]int64, len(values))
+	for v, count := range values {
+		durations[time.Duration(v*float64(time.Second))] = count
+	}
+	return durations
+}
+
+// Schema returns the histogram's current schema, which may have decreased
+// from its configured value if it has ever been rescaled.
+func (h *sparseHistogram) Schema() int8 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.schema
+}
+
+// BucketCounts returns a copy of the populated positive and negative
+// buckets, keyed by index.
+func (h *sparseHistogram) BucketCounts() (positive, negative map[int]uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return copyUint64Map(h.positive), copyUint64Map(h.negative)
+}
+
+func copyUint64Map(m map[int]uint64) map[int]uint64 {
+	cp := make(map[int]uint64, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
+// SparseHistogramSnapshot extends HistogramSnapshot with the extra state
+// tests need to assert on for a sparse histogram: its current schema and
+// its populated buckets by index.
+type SparseHistogramSnapshot interface {
+	HistogramSnapshot
+
+	// Schema returns the histogram's current schema.
+	Schema() int8
+
+	// PositiveBucketCounts returns populated positive-index bucket counts.
+	PositiveBucketCounts() map[int]uint64
+
+	// NegativeBucketCounts returns populated negative-index bucket counts.
+	NegativeBucketCounts() map[int]uint64
+}
+
+type sparseHistogramSnapshot struct {
+	*histogramSnapshot
+
+	schema   int8
+	positive map[int]uint64
+	negative map[int]uint64
+}
+
+func (s *sparseHistogramSnapshot) Schema() int8 {
+	return s.schema
+}
+
+func (s *sparseHistogramSnapshot) PositiveBucketCounts() map[int]uint64 {
+	return s.positive
+}
+
+func (s *sparseHistogramSnapshot) NegativeBucketCounts() map[int]uint64 {
+	return s.negative
+}
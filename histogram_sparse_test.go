@@ -0,0 +1,95 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tally
+
+import "testing"
+
+func TestSparseHistogramZeroThreshold(t *testing.T) {
+	h := newSparseHistogram("test", nil, nil, nil, ExponentialBuckets{
+		Schema:        0,
+		MaxBuckets:    100,
+		ZeroThreshold: 1,
+	})
+
+	h.RecordValue(0.5)
+	h.RecordValue(-0.5)
+	h.RecordValue(5)
+
+	h.mu.Lock()
+	zero := h.zeroCount
+	h.mu.Unlock()
+	positive, negative := h.BucketCounts()
+
+	if zero != 2 {
+		t.Fatalf("zeroCount = %d, want 2 (both values within ZeroThreshold should be "+
+			"absorbed into the zero bucket instead of a positive/negative one)", zero)
+	}
+	if len(positive) != 1 || len(negative) != 0 {
+		t.Fatalf("positive/negative buckets = %v/%v, want exactly one positive bucket for 5",
+			positive, negative)
+	}
+}
+
+func TestSparseHistogramDefaultZeroThresholdOnlyAbsorbsExactZero(t *testing.T) {
+	h := newSparseHistogram("test", nil, nil, nil, ExponentialBuckets{
+		Schema:     0,
+		MaxBuckets: 100,
+	})
+
+	h.RecordValue(0)
+	h.RecordValue(0.5)
+
+	h.mu.Lock()
+	zero := h.zeroCount
+	h.mu.Unlock()
+	positive, _ := h.BucketCounts()
+
+	if zero != 1 {
+		t.Fatalf("zeroCount = %d, want 1 (ZeroThreshold defaults to 0, so only an exact "+
+			"zero observation should land there)", zero)
+	}
+	if len(positive) != 1 {
+		t.Fatalf("positive buckets = %v, want exactly one populated bucket for 0.5", positive)
+	}
+}
+
+func TestSparseHistogramRescalesOnOverflow(t *testing.T) {
+	h := newSparseHistogram("test", nil, nil, nil, ExponentialBuckets{
+		Schema:     4,
+		MaxBuckets: 2,
+	})
+
+	for _, v := range []float64{1, 2, 4, 8, 16, 32} {
+		h.RecordValue(v)
+	}
+
+	schema := h.Schema()
+	positive, negative := h.BucketCounts()
+	bucketCount := len(positive) + len(negative)
+
+	if bucketCount > 2 {
+		t.Fatalf("bucket count = %d, want <= MaxBuckets (2) after rescaling", bucketCount)
+	}
+	if schema >= 4 {
+		t.Fatalf("schema = %d, want < 4 (overflowing MaxBuckets should have halved resolution "+
+			"at least once)", schema)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package otlp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+
+	"github.com/uber-go/tally"
+)
+
+// cachedCounter is allocated once by AllocateCounter; the OTLP Metric and
+// its Attribute slice are built at allocation time so every ReportCount
+// afterwards only needs to update and append total under mu.
+type cachedCounter struct {
+	name       string
+	attributes []*commonpb.KeyValue
+	queueSize  int
+	dropped    *int64
+
+	mu     sync.Mutex
+	points []int64
+
+	total int64
+}
+
+// ReportCount implements tally.CachedCount. total is updated and appended
+// to points under the same lock, so two concurrent ReportCounts can never
+// append their totals out of order and produce a non-monotonic Sum.
+func (c *cachedCounter) ReportCount(value int64) {
+	c.mu.Lock()
+	c.total += value
+	if len(c.points) >= c.queueSize {
+		atomic.AddInt64(c.dropped, 1)
+	} else {
+		c.points = append(c.points, c.total)
+	}
+	c.mu.Unlock()
+}
+
+func (c *cachedCounter) collect() *metricpb.Metric {
+	c.mu.Lock()
+	if len(c.points) == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	last := c.points[len(c.points)-1]
+	c.points = c.points[:0]
+	c.mu.Unlock()
+
+	now := uint64(time.Now().UnixNano())
+	return &metricpb.Metric{
+		Name: c.name,
+		Data: &metricpb.Metric_Sum{
+			Sum: &metricpb.Sum{
+				AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:             true,
+				DataPoints: []*metricpb.NumberDataPoint{
+					{
+						Attributes:   c.attributes,
+						TimeUnixNano: now,
+						Value:        &metricpb.NumberDataPoint_AsInt{AsInt: last},
+					},
+				},
+			},
+		},
+	}
+}
+
+// cachedGauge is allocated once by AllocateGauge.
+type cachedGauge struct {
+	name       string
+	attributes []*commonpb.KeyValue
+	queueSize  int
+	dropped    *int64
+
+	mu     sync.Mutex
+	points []float64
+}
+
+// ReportGauge implements tally.CachedGauge.
+func (g *cachedGauge) ReportGauge(value float64) {
+	g.mu.Lock()
+	if len(g.points) >= g.queueSize {
+		atomic.AddInt64(g.dropped, 1)
+	} else {
+		g.points = append(g.points, value)
+	}
+	g.mu.Unlock()
+}
+
+func (g *cachedGauge) collect() *metricpb.Metric {
+	g.mu.Lock()
+	if len(g.points) == 0 {
+		g.mu.Unlock()
+		return nil
+	}
+	last := g.points[len(g.points)-1]
+	g.points = g.points[:0]
+	g.mu.Unlock()
+
+	now := uint64(time.Now().UnixNano())
+	return &metricpb.Metric{
+		Name: g.name,
+		Data: &metricpb.Metric_Gauge{
+			Gauge: &metricpb.Gauge{
+				DataPoints: []*metricpb.NumberDataPoint{
+					{
+						Attributes:   g.attributes,
+						TimeUnixNano: now,
+						Value:        &metricpb.NumberDataPoint_AsDouble{AsDouble: last},
+					},
+				},
+			},
+		},
+	}
+}
+
+// cachedHistogram backs both AllocateHistogram and, via cachedTimer,
+// AllocateTimer. Bucket counts are atomic so recording a value is a single
+// atomic add into its bucket's counter; collect reads and resets them.
+type cachedHistogram struct {
+	name       string
+	attributes []*commonpb.KeyValue
+	bounds     []float64
+
+	bucketCounts []int64 // len(bounds)+1, last is the +Inf bucket
+	sumBits      uint64  // math.Float64bits, updated via CAS loop
+	count        int64
+}
+
+func newCachedHistogram(name string, tags map[string]string, bounds []float64) *cachedHistogram {
+	return &cachedHistogram{
+		name:         name,
+		attributes:   attributesFromTags(tags),
+		bounds:       bounds,
+		bucketCounts: make([]int64, len(bounds)+1),
+	}
+}
+
+// ValueBucket implements tally.CachedHistogram.
+func (h *cachedHistogram) ValueBucket(bucketLowerBound, bucketUpperBound float64) tally.CachedHistogramBucket {
+	return &cachedHistogramBucket{h: h, index: h.indexOf(bucketUpperBound)}
+}
+
+// DurationBucket implements tally.CachedHistogram.
+func (h *cachedHistogram) DurationBucket(bucketLowerBound, bucketUpperBound time.Duration) tally.CachedHistogramBucket {
+	return &cachedHistogramBucket{h: h, index: h.indexOf(float64(bucketUpperBound))}
+}
+
+func (h *cachedHistogram) indexOf(upperBound float64) int {
+	for i, b := range h.bounds {
+		if upperBound <= b {
+			return i
+		}
+	}
+	return len(h.bounds)
+}
+
+func (h *cachedHistogram) record(value float64) {
+	atomic.AddInt64(&h.count, 1)
+	addFloat64(&h.sumBits, value)
+}
+
+func (h *cachedHistogram) collect() *metricpb.Metric {
+	count := atomic.SwapInt64(&h.count, 0)
+	if count == 0 {
+		return nil
+	}
+	sum := swapFloat64(&h.sumBits, 0)
+
+	counts := make([]uint64, len(h.bucketCounts))
+	for i := range h.bucketCounts {
+		counts[i] = uint64(atomic.SwapInt64(&h.bucketCounts[i], 0))
+	}
+
+	now := uint64(time.Now().UnixNano())
+	return &metricpb.Metric{
+		Name: h.name,
+		Data: &metricpb.Metric_Histogram{
+			Histogram: &metricpb.Histogram{
+				AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				DataPoints: []*metricpb.HistogramDataPoint{
+					{
+						Attributes:     h.attributes,
+						TimeUnixNano:   now,
+						Count:          uint64(count),
+						Sum:            &sum,
+						BucketCounts:   counts,
+						ExplicitBounds: h.bounds,
+					},
+				},
+			},
+		},
+	}
+}
+
+type cachedHistogramBucket struct {
+	h     *cachedHistogram
+	index int
+}
+
+// RecordValue implements tally.CachedHistogramBucket.
+func (b *cachedHistogramBucket) RecordValue(value float64) {
+	atomic.AddInt64(&b.h.bucketCounts[b.index], 1)
+	b.h.record(value)
+}
+
+// RecordDuration implements tally.CachedHistogramBucket.
+func (b *cachedHistogramBucket) RecordDuration(value time.Duration) {
+	atomic.AddInt64(&b.h.bucketCounts[b.index], 1)
+	b.h.record(float64(value))
+}
+
+// RecordSamples implements tally.CachedHistogramBucket.
+func (b *cachedHistogramBucket) RecordSamples(value int64) {
+	atomic.AddInt64(&b.h.bucketCounts[b.index], value)
+	atomic.AddInt64(&b.h.count, value)
+}
+
+// cachedTimer adapts a cachedHistogram to tally.CachedTimer, whose
+// ReportTimer reports a single observed duration directly rather than
+// going through a pre-selected bucket.
+type cachedTimer struct {
+	*cachedHistogram
+}
+
+// ReportTimer implements tally.CachedTimer.
+func (t *cachedTimer) ReportTimer(interval time.Duration) {
+	idx := t.indexOf(float64(interval))
+	atomic.AddInt64(&t.bucketCounts[idx], 1)
+	t.record(float64(interval))
+}
+
+func attributesFromTags(tags map[string]string) []*commonpb.KeyValue {
+	attrs := make([]*commonpb.KeyValue, 0, len(tags))
+	for k, v := range tags {
+		attrs = append(attrs, stringKeyValue(k, v))
+	}
+	return attrs
+}
+
+func stringKeyValue(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+func bucketBoundsFromDurations(buckets tally.DurationBuckets) []float64 {
+	bounds := make([]float64, len(buckets))
+	for i, b := range buckets {
+		bounds[i] = float64(b)
+	}
+	return bounds
+}
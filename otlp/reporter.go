@@ -0,0 +1,303 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package otlp implements a tally.CachedStatsReporter that batches metrics
+// into OpenTelemetry protobufs and ships them to an OTLP endpoint on Flush.
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+
+	"github.com/uber-go/tally"
+)
+
+const (
+	_defaultQueueSize = 10000
+	_defaultTimeout   = 10 * time.Second
+)
+
+// Options configures a Reporter.
+type Options struct {
+	// Endpoint is the OTLP gRPC collector address, e.g. "localhost:4317".
+	// Only gRPC export is supported; there is no OTLP/HTTP transport.
+	Endpoint string
+	// ResourceAttributes are attached to every exported ResourceMetrics.
+	ResourceAttributes map[string]string
+	// QueueSize bounds the number of buffered data points per cached
+	// counter/gauge between flushes; once full, new points are dropped and
+	// DroppedPoints is incremented. Timers and histograms accumulate into
+	// bucket counters and are not bounded by it. Defaults to 10000.
+	QueueSize int
+	// FlushTimeout bounds how long a single Flush may take to export.
+	// Defaults to 10s.
+	FlushTimeout time.Duration
+	// GRPCDialOptions are passed through to grpc.Dial when connecting to
+	// Endpoint.
+	GRPCDialOptions []grpc.DialOption
+	// DefaultBuckets is the fallback bucket boundaries used to export a
+	// Timer as an OTLP histogram when the scope's actual
+	// ScopeOptions.DefaultBuckets couldn't be threaded through - i.e. a
+	// Timer allocated by something other than scope.TimerWithOptions, which
+	// feature-detects CachedBucketedTimerReporter and passes the scope's
+	// real buckets directly. Defaults to defaultTimerBuckets.
+	DefaultBuckets tally.Buckets
+}
+
+// defaultTimerBuckets mirrors tally's own default scope buckets, used when
+// Options.DefaultBuckets is unset.
+var defaultTimerBuckets = tally.DurationBuckets{
+	0 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	75 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	300 * time.Millisecond,
+	400 * time.Millisecond,
+	500 * time.Millisecond,
+	600 * time.Millisecond,
+	800 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// Reporter is a tally.CachedStatsReporter that batches counters, gauges,
+// timers and histograms into OTLP pmetric protobufs and exports them via
+// gRPC on Flush.
+type Reporter struct {
+	opts     Options
+	conn     *grpc.ClientConn
+	client   colmetricpb.MetricsServiceClient
+	resource *resourcepb.Resource
+
+	mu      sync.Mutex
+	metrics []cachedMetric
+
+	droppedPoints int64
+}
+
+// cachedMetric is the common interface satisfied by every allocated cached
+// counter/gauge/timer/histogram; Flush calls collect to build this metric's
+// OTLP payload and reset its buffered state.
+type cachedMetric interface {
+	collect() *metricpb.Metric
+}
+
+// NewReporter dials opts.Endpoint and returns a Reporter ready to be used
+// as a tally.CachedStatsReporter.
+func NewReporter(opts Options) (*Reporter, error) {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = _defaultQueueSize
+	}
+	if opts.FlushTimeout <= 0 {
+		opts.FlushTimeout = _defaultTimeout
+	}
+	if opts.DefaultBuckets == nil {
+		opts.DefaultBuckets = defaultTimerBuckets
+	}
+
+	conn, err := grpc.Dial(opts.Endpoint, opts.GRPCDialOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make([]*commonpb.KeyValue, 0, len(opts.ResourceAttributes))
+	for k, v := range opts.ResourceAttributes {
+		attrs = append(attrs, stringKeyValue(k, v))
+	}
+
+	return &Reporter{
+		opts:     opts,
+		conn:     conn,
+		client:   colmetricpb.NewMetricsServiceClient(conn),
+		resource: &resourcepb.Resource{Attributes: attrs},
+	}, nil
+}
+
+// AllocateCounter implements tally.CachedStatsReporter. It pre-builds the
+// OTLP Metric and Attribute slice once, so that every subsequent
+// ReportCount is an add and a queue append under the counter's mutex.
+func (r *Reporter) AllocateCounter(name string, tags map[string]string) tally.CachedCount {
+	c := &cachedCounter{
+		name:       name,
+		attributes: attributesFromTags(tags),
+		queueSize:  r.opts.QueueSize,
+		dropped:    &r.droppedPoints,
+	}
+	r.register(c)
+	return c
+}
+
+// AllocateGauge implements tally.CachedStatsReporter.
+func (r *Reporter) AllocateGauge(name string, tags map[string]string) tally.CachedGauge {
+	g := &cachedGauge{
+		name:       name,
+		attributes: attributesFromTags(tags),
+		queueSize:  r.opts.QueueSize,
+		dropped:    &r.droppedPoints,
+	}
+	r.register(g)
+	return g
+}
+
+// AllocateTimer implements tally.CachedStatsReporter. AllocateTimer's
+// (name, tags) signature has no way to carry the scope's actual
+// ScopeOptions.DefaultBuckets, so a Timer allocated through it alone is
+// bucketed from Options.DefaultBuckets instead, which may not match. A
+// scope routes through AllocateBucketedTimer instead whenever it detects
+// CachedBucketedTimerReporter support, which this Reporter also implements.
+func (r *Reporter) AllocateTimer(name string, tags map[string]string) tally.CachedTimer {
+	durationBuckets, ok := r.opts.DefaultBuckets.(tally.DurationBuckets)
+	if !ok {
+		durationBuckets = defaultTimerBuckets
+	}
+	return r.allocateTimerWithBounds(name, tags, bucketBoundsFromDurations(durationBuckets))
+}
+
+// AllocateBucketedTimer implements the optional
+// tally.CachedBucketedTimerReporter extension, letting a scope pass its own
+// ScopeOptions.DefaultBuckets through at allocation time so a Timer's OTLP
+// histogram is bucketed identically to the scope's own dense histograms,
+// rather than relying on Options.DefaultBuckets to happen to mirror it.
+func (r *Reporter) AllocateBucketedTimer(
+	name string,
+	tags map[string]string,
+	buckets tally.Buckets,
+) tally.CachedTimer {
+	return r.allocateTimerWithBounds(name, tags, boundsFromBuckets(buckets))
+}
+
+func (r *Reporter) allocateTimerWithBounds(name string, tags map[string]string, bounds []float64) tally.CachedTimer {
+	t := &cachedTimer{
+		cachedHistogram: newCachedHistogram(name, tags, bounds),
+	}
+	r.register(t)
+	return t
+}
+
+// AllocateHistogram implements tally.CachedStatsReporter. DurationBuckets
+// and ValueBuckets are both mapped onto OTLP explicit bucket boundaries.
+func (r *Reporter) AllocateHistogram(
+	name string,
+	tags map[string]string,
+	buckets tally.Buckets,
+) tally.CachedHistogram {
+	h := newCachedHistogram(name, tags, boundsFromBuckets(buckets))
+	r.register(h)
+	return h
+}
+
+// boundsFromBuckets derives OTLP explicit bucket boundaries from a
+// tally.Buckets, the conversion AllocateHistogram and AllocateBucketedTimer
+// both need.
+func boundsFromBuckets(buckets tally.Buckets) []float64 {
+	switch b := buckets.(type) {
+	case tally.DurationBuckets:
+		return bucketBoundsFromDurations(b)
+	case tally.ValueBuckets:
+		return []float64(b)
+	}
+	return nil
+}
+
+func (r *Reporter) register(m cachedMetric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// Flush implements tally.CachedStatsReporter. It collects every allocated
+// metric's buffered data points, builds an ExportMetricsServiceRequest and
+// sends it to the OTLP endpoint, discarding any export error. Use
+// FlushWithError to observe it.
+func (r *Reporter) Flush() {
+	_ = r.FlushWithError()
+}
+
+// FlushWithError is the tally.FlushWithError extension to Flush, returning
+// the gRPC Export error (if any) instead of swallowing it, so a scope's
+// CloseWithContext can surface a failed final flush.
+func (r *Reporter) FlushWithError() error {
+	r.mu.Lock()
+	pbMetrics := make([]*metricpb.Metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		if pb := m.collect(); pb != nil {
+			pbMetrics = append(pbMetrics, pb)
+		}
+	}
+	r.mu.Unlock()
+
+	if len(pbMetrics) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.FlushTimeout)
+	defer cancel()
+
+	req := &colmetricpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricpb.ResourceMetrics{
+			{
+				Resource: r.resource,
+				ScopeMetrics: []*metricpb.ScopeMetrics{
+					{Metrics: pbMetrics},
+				},
+			},
+		},
+	}
+	if _, err := r.client.Export(ctx, req); err != nil {
+		return fmt.Errorf("otlp: export failed: %w", err)
+	}
+	return nil
+}
+
+// Capabilities implements tally.BaseStatsReporter.
+func (r *Reporter) Capabilities() tally.Capabilities {
+	return capabilitiesReportingTagging{}
+}
+
+// capabilitiesReportingTagging is the Reporter's tally.Capabilities: it
+// supports both emitting values and per-metric tags.
+type capabilitiesReportingTagging struct{}
+
+func (capabilitiesReportingTagging) Reporting() bool { return true }
+func (capabilitiesReportingTagging) Tagging() bool   { return true }
+
+// Close closes the underlying OTLP connection.
+func (r *Reporter) Close() error {
+	return r.conn.Close()
+}
+
+// DroppedPoints returns the number of data points dropped because a cached
+// metric's bounded queue was full at observation time.
+func (r *Reporter) DroppedPoints() int64 {
+	return atomic.LoadInt64(&r.droppedPoints)
+}
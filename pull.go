@@ -0,0 +1,361 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tally
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrometheusPullReporter is a StatsReporter/CachedStatsReporter that does not
+// emit metrics on a ticker. Instead it relies on the scope registry already
+// buffering the latest value of every counter, gauge, SummaryTimer and
+// histogram, and exposes a Handler that materializes them in the Prometheus
+// text exposition format on demand. A standard Timer reports directly to its
+// StatsReporter without any buffering of its own (see scope.go's report/
+// cachedReport), so PrometheusPullReporter buffers the last-reported value
+// of each one itself in ReportTimer, gauge-style. Construct the root scope
+// with interval == 0 so that reportLoop is never started, and pass Handler
+// the same root Scope to serve from, e.g. on a "/metrics" route.
+//
+//	root, closer := tally.NewRootScope(tally.ScopeOptions{
+//		Reporter: tally.NewPrometheusPullReporter(tally.PrometheusPullReporterOptions{}),
+//	}, 0)
+//	http.Handle("/metrics", tally.NewPrometheusPullHandler(root))
+type PrometheusPullReporter struct {
+	opts PrometheusPullReporterOptions
+
+	mu     sync.Mutex
+	timers map[string]pullTimerSample
+}
+
+// pullTimerSample is the last-reported value of one standard Timer,
+// buffered so ServeHTTP has something to scrape for it.
+type pullTimerSample struct {
+	name     string
+	tags     map[string]string
+	interval time.Duration
+}
+
+// PrometheusPullReporterOptions is a set of options for a PrometheusPullReporter.
+type PrometheusPullReporterOptions struct {
+	// OnRegisterError is called if an error is encountered while rendering
+	// a scrape. If unset, render errors are silently ignored.
+	OnRegisterError func(err error)
+}
+
+// NewPrometheusPullReporter creates a new PrometheusPullReporter. It
+// implements both StatsReporter and CachedStatsReporter so it can be
+// passed as either ScopeOptions.Reporter or ScopeOptions.CachedReporter.
+// Reporting is a no-op, as values are read directly from the scope registry
+// at scrape time via NewPrometheusPullHandler, except for ReportTimer, which
+// buffers each standard Timer's last value. The CachedTimer returned by
+// AllocateTimer is a no-op, so on a scope built with this as its
+// CachedReporter, standard Timers do not appear in a scrape.
+func NewPrometheusPullReporter(opts PrometheusPullReporterOptions) *PrometheusPullReporter {
+	return &PrometheusPullReporter{opts: opts}
+}
+
+// ReportCounter implements StatsReporter.
+func (r *PrometheusPullReporter) ReportCounter(name string, tags map[string]string, value int64) {}
+
+// ReportGauge implements StatsReporter.
+func (r *PrometheusPullReporter) ReportGauge(name string, tags map[string]string, value float64) {}
+
+// ReportTimer implements StatsReporter. A standard Timer reports every
+// observation directly here rather than buffering in the scope registry, so
+// this buffers the last-reported value itself (gauge-style) for ServeHTTP
+// to read at scrape time; see snapshotTimers.
+func (r *PrometheusPullReporter) ReportTimer(name string, tags map[string]string, interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.timers == nil {
+		r.timers = make(map[string]pullTimerSample)
+	}
+	r.timers[KeyForPrefixedStringMap(name, tags)] = pullTimerSample{
+		name:     name,
+		tags:     tags,
+		interval: interval,
+	}
+}
+
+// snapshotTimers returns the last-reported value of every standard Timer
+// seen since PrometheusPullReporter was constructed.
+func (r *PrometheusPullReporter) snapshotTimers() []pullTimerSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	samples := make([]pullTimerSample, 0, len(r.timers))
+	for _, s := range r.timers {
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+// ReportHistogramValueSamples implements StatsReporter.
+func (r *PrometheusPullReporter) ReportHistogramValueSamples(
+	name string,
+	tags map[string]string,
+	buckets Buckets,
+	bucketLowerBound,
+	bucketUpperBound float64,
+	samples int64,
+) {
+}
+
+// ReportHistogramDurationSamples implements StatsReporter.
+func (r *PrometheusPullReporter) ReportHistogramDurationSamples(
+	name string,
+	tags map[string]string,
+	buckets Buckets,
+	bucketLowerBound,
+	bucketUpperBound time.Duration,
+	samples int64,
+) {
+}
+
+// AllocateCounter implements CachedStatsReporter.
+func (r *PrometheusPullReporter) AllocateCounter(name string, tags map[string]string) CachedCount {
+	return prometheusPullNoopCount{}
+}
+
+// AllocateGauge implements CachedStatsReporter.
+func (r *PrometheusPullReporter) AllocateGauge(name string, tags map[string]string) CachedGauge {
+	return prometheusPullNoopGauge{}
+}
+
+// AllocateTimer implements CachedStatsReporter.
+func (r *PrometheusPullReporter) AllocateTimer(name string, tags map[string]string) CachedTimer {
+	return prometheusPullNoopTimer{}
+}
+
+// AllocateHistogram implements CachedStatsReporter.
+func (r *PrometheusPullReporter) AllocateHistogram(
+	name string,
+	tags map[string]string,
+	buckets Buckets,
+) CachedHistogram {
+	return prometheusPullNoopHistogram{}
+}
+
+// Flush implements BaseStatsReporter. There is nothing to flush, since
+// values are read directly from the scope registry on scrape.
+func (r *PrometheusPullReporter) Flush() {}
+
+// Capabilities implements BaseStatsReporter.
+func (r *PrometheusPullReporter) Capabilities() Capabilities {
+	return capabilitiesReportingTagging
+}
+
+// NewPrometheusPullHandler returns an http.Handler that renders every
+// counter, gauge, timer and histogram currently buffered in root's scope
+// registry in the Prometheus text exposition format. root must have been
+// created with a PrometheusPullReporter as either its Reporter or
+// CachedReporter.
+func NewPrometheusPullHandler(root Scope) http.Handler {
+	s, ok := root.(*scope)
+	if !ok {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "tally: scope does not support prometheus pull scraping", http.StatusInternalServerError)
+		})
+	}
+	return &prometheusPullHandler{root: s}
+}
+
+type prometheusPullHandler struct {
+	root *scope
+}
+
+func (h *prometheusPullHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf strings.Builder
+
+	h.root.registry.ForEachScope(func(ss *scope) {
+		ss.counters.forEach(func(name string, v interface{}) {
+			c := v.(*counter)
+			writePrometheusMetric(&buf, ss.fullyQualifiedName(name), ss.tags, float64(c.snapshot()))
+		})
+
+		ss.gauges.forEach(func(name string, v interface{}) {
+			g := v.(*gauge)
+			writePrometheusMetric(&buf, ss.fullyQualifiedName(name), ss.tags, g.snapshot())
+		})
+
+		ss.histograms.forEach(func(name string, v interface{}) {
+			hi := v.(reportableHistogram)
+			fqn := ss.fullyQualifiedName(name)
+			if values := hi.snapshotValues(); len(values) > 0 {
+				writePrometheusHistogram(&buf, fqn, ss.tags, valuesToBucketCounts(values))
+			}
+			if durations := hi.snapshotDurations(); len(durations) > 0 {
+				writePrometheusHistogram(&buf, fqn, ss.tags, durationsToBucketCounts(durations))
+			}
+		})
+
+		ss.summaryTimers.forEach(func(name string, v interface{}) {
+			st := v.(*summaryTimer)
+			fqn := ss.fullyQualifiedName(name)
+			for q, d := range st.snapshotQuantiles() {
+				tags := make(map[string]string, len(ss.tags)+1)
+				for k, v := range ss.tags {
+					tags[k] = v
+				}
+				tags["quantile"] = fmt.Sprintf("%v", q)
+				writePrometheusMetric(&buf, fqn, tags, d.Seconds())
+			}
+		})
+	})
+
+	// Standard timers (unlike summary timers) aren't buffered per-scope in
+	// the registry; they report straight to the reporter, which is why
+	// PrometheusPullReporter itself buffers their last value. There's one
+	// reporter shared by every scope, so read it once here rather than once
+	// per scope above.
+	if pr, ok := h.root.baseReporter.(*PrometheusPullReporter); ok {
+		for _, sample := range pr.snapshotTimers() {
+			writePrometheusMetric(&buf, sample.name, sample.tags, sample.interval.Seconds())
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := w.Write([]byte(buf.String())); err != nil {
+		if pr, ok := h.root.baseReporter.(*PrometheusPullReporter); ok && pr.opts.OnRegisterError != nil {
+			pr.opts.OnRegisterError(err)
+		}
+	}
+}
+
+// prometheusBucketCount is an upper bound paired with the (non-cumulative)
+// number of samples observed in that bucket.
+type prometheusBucketCount struct {
+	upperBound string
+	count      int64
+}
+
+func valuesToBucketCounts(values map[float64]int64) []prometheusBucketCount {
+	bounds := make([]float64, 0, len(values))
+	for b := range values {
+		bounds = append(bounds, b)
+	}
+	sort.Float64s(bounds)
+
+	counts := make([]prometheusBucketCount, 0, len(bounds))
+	for _, b := range bounds {
+		upperBound := "+Inf"
+		if b != math.MaxFloat64 {
+			upperBound = fmt.Sprintf("%v", b)
+		}
+		counts = append(counts, prometheusBucketCount{upperBound: upperBound, count: values[b]})
+	}
+	return counts
+}
+
+func durationsToBucketCounts(durations map[time.Duration]int64) []prometheusBucketCount {
+	bounds := make([]time.Duration, 0, len(durations))
+	for b := range durations {
+		bounds = append(bounds, b)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	counts := make([]prometheusBucketCount, 0, len(bounds))
+	for _, b := range bounds {
+		upperBound := "+Inf"
+		if b != time.Duration(math.MaxInt64) {
+			upperBound = fmt.Sprintf("%v", b.Seconds())
+		}
+		counts = append(counts, prometheusBucketCount{upperBound: upperBound, count: durations[b]})
+	}
+	return counts
+}
+
+func writePrometheusHistogram(
+	buf *strings.Builder,
+	name string,
+	tags map[string]string,
+	buckets []prometheusBucketCount,
+) {
+	var cumulative int64
+	for _, b := range buckets {
+		cumulative += b.count
+		bucketTags := make(map[string]string, len(tags)+1)
+		for k, v := range tags {
+			bucketTags[k] = v
+		}
+		bucketTags["le"] = b.upperBound
+		writePrometheusMetric(buf, name+"_bucket", bucketTags, float64(cumulative))
+	}
+}
+
+func writePrometheusMetric(buf *strings.Builder, name string, tags map[string]string, value float64) {
+	buf.WriteString(name)
+	if len(tags) > 0 {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=%q", k, tags[k])
+		}
+		buf.WriteByte('}')
+	}
+	fmt.Fprintf(buf, " %v\n", value)
+}
+
+type prometheusPullNoopCount struct{}
+
+func (prometheusPullNoopCount) ReportCount(value int64) {}
+
+type prometheusPullNoopGauge struct{}
+
+func (prometheusPullNoopGauge) ReportGauge(value float64) {}
+
+type prometheusPullNoopTimer struct{}
+
+func (prometheusPullNoopTimer) ReportTimer(interval time.Duration) {}
+
+type prometheusPullNoopHistogram struct{}
+
+func (prometheusPullNoopHistogram) ValueBucket(bucketLowerBound, bucketUpperBound float64) CachedHistogramBucket {
+	return prometheusPullNoopHistogramBucket{}
+}
+
+func (prometheusPullNoopHistogram) DurationBucket(bucketLowerBound, bucketUpperBound time.Duration) CachedHistogramBucket {
+	return prometheusPullNoopHistogramBucket{}
+}
+
+type prometheusPullNoopHistogramBucket struct{}
+
+func (prometheusPullNoopHistogramBucket) RecordValue(value float64) {}
+
+func (prometheusPullNoopHistogramBucket) RecordDuration(value time.Duration) {}
+
+func (prometheusPullNoopHistogramBucket) RecordSamples(value int64) {}
@@ -21,6 +21,7 @@
 package tally
 
 import (
+	"context"
 	"io"
 	"math"
 	"sync"
@@ -29,10 +30,6 @@ import (
 	"github.com/uber-go/tally/internal/identity"
 )
 
-const (
-	_defaultInitialSliceSize = 16
-)
-
 var (
 	// NoopScope is a scope that does nothing
 	NoopScope, _ = NewRootScope(ScopeOptions{Reporter: NullStatsReporter}, 0)
@@ -61,34 +58,32 @@ var (
 )
 
 type scope struct {
-	separator      string
-	prefix         string
-	tags           map[string]string
-	reporter       StatsReporter
-	cachedReporter CachedStatsReporter
-	baseReporter   BaseStatsReporter
-	defaultBuckets Buckets
-	sanitizer      Sanitizer
+	separator        string
+	prefix           string
+	tags             map[string]string
+	reporter         StatsReporter
+	cachedReporter   CachedStatsReporter
+	baseReporter     BaseStatsReporter
+	defaultBuckets   Buckets
+	defaultTimerType TimerType
+	closeTimeout     time.Duration
+	sanitizer        Sanitizer
 
 	registry *scopeRegistry
 	status   scopeStatus
 
-	cm sync.RWMutex
-	gm sync.RWMutex
-	tm sync.RWMutex
-	hm sync.RWMutex
+	counters      *shardedMetrics // name -> *counter
+	gauges        *shardedMetrics // name -> *gauge
+	histograms    *shardedMetrics // name -> reportableHistogram
+	timers        *shardedMetrics // name -> *timer
+	summaryTimers *shardedMetrics // name -> *summaryTimer
 
-	counters        map[string]*counter
-	countersSlice   []*counter
-	gauges          map[string]*gauge
-	gaugesSlice     []*gauge
-	histograms      map[string]*histogram
-	histogramsSlice []*histogram
-	timers          map[string]*timer
-	// nb: deliberately skipping timersSlice as we report timers immediately,
-	// no buffering is involved.
-
-	bucketCache map[uint64]bucketStorage
+	// bucketCache deduplicates histogram bucket storage by bucket content
+	// across all histograms in the scope; it's orthogonal to the sharding
+	// above; a single mutex is fine since creation, not lookup, is its only
+	// access path.
+	bucketCacheMu sync.Mutex
+	bucketCache   map[uint64]bucketStorage
 }
 
 // n.b. This function is used to uniquely identify a given set of buckets
@@ -127,11 +122,29 @@ type ScopeOptions struct {
 	Separator       string
 	DefaultBuckets  Buckets
 	SanitizeOptions *SanitizeOptions
+	// DefaultTimerType selects how Timer(name) aggregates observations
+	// for timers created without explicit TimerOptions. Defaults to
+	// StandardTimerType. Use TimerWithOptions to override per-metric.
+	DefaultTimerType TimerType
+	// MetricShards is the number of shards each metric kind (counters,
+	// gauges, histograms, timers) is split across, to reduce lock
+	// contention between concurrent creators and reporters in scopes with
+	// many distinct metrics. Defaults to 16.
+	MetricShards int
+	// CloseTimeout bounds how long Close waits for the scope's final flush
+	// to complete, e.g. when called from a signal handler with a fixed
+	// shutdown budget. Unset (the default) means Close waits indefinitely,
+	// matching its prior behavior. Use CloseWithContext directly to supply
+	// a per-call deadline instead.
+	CloseTimeout time.Duration
 }
 
 // NewRootScope creates a new root Scope with a set of options and
 // a reporting interval.
 // Must provide either a StatsReporter or a CachedStatsReporter.
+// Pass interval == 0 to disable the periodic reportLoop entirely, e.g.
+// when the reporter is pull-based (see PrometheusPullReporter) and values
+// are only read from the registry on scrape.
 func NewRootScope(opts ScopeOptions, interval time.Duration) (Scope, io.Closer) {
 	s := newRootScope(opts, interval)
 	return s, s
@@ -172,26 +185,26 @@ func newRootScope(opts ScopeOptions, interval time.Duration) *scope {
 	}
 
 	s := &scope{
-		separator:      sanitizer.Name(opts.Separator),
-		prefix:         sanitizer.Name(opts.Prefix),
-		reporter:       opts.Reporter,
-		cachedReporter: opts.CachedReporter,
-		baseReporter:   baseReporter,
-		defaultBuckets: opts.DefaultBuckets,
-		sanitizer:      sanitizer,
+		separator:        sanitizer.Name(opts.Separator),
+		prefix:           sanitizer.Name(opts.Prefix),
+		reporter:         opts.Reporter,
+		cachedReporter:   opts.CachedReporter,
+		baseReporter:     baseReporter,
+		defaultBuckets:   opts.DefaultBuckets,
+		defaultTimerType: opts.DefaultTimerType,
+		closeTimeout:     opts.CloseTimeout,
+		sanitizer:        sanitizer,
 		status: scopeStatus{
 			closed: false,
 			quit:   make(chan struct{}, 1),
 		},
 
-		counters:        make(map[string]*counter),
-		countersSlice:   make([]*counter, 0, _defaultInitialSliceSize),
-		gauges:          make(map[string]*gauge),
-		gaugesSlice:     make([]*gauge, 0, _defaultInitialSliceSize),
-		histograms:      make(map[string]*histogram),
-		histogramsSlice: make([]*histogram, 0, _defaultInitialSliceSize),
-		timers:          make(map[string]*timer),
-		bucketCache:     make(map[uint64]bucketStorage),
+		counters:      newShardedMetrics(opts.MetricShards),
+		gauges:        newShardedMetrics(opts.MetricShards),
+		histograms:    newShardedMetrics(opts.MetricShards),
+		timers:        newShardedMetrics(opts.MetricShards),
+		summaryTimers: newShardedMetrics(opts.MetricShards),
+		bucketCache:   make(map[uint64]bucketStorage),
 	}
 
 	// NB(r): Take a copy of the tags on creation
@@ -210,47 +223,45 @@ func newRootScope(opts ScopeOptions, interval time.Duration) *scope {
 
 // report dumps all aggregated stats into the reporter. Should be called automatically by the root scope periodically.
 func (s *scope) report(r StatsReporter) {
-	s.cm.RLock()
-	for name, counter := range s.counters {
-		counter.report(s.fullyQualifiedName(name), s.tags, r)
-	}
-	s.cm.RUnlock()
+	s.counters.forEach(func(name string, v interface{}) {
+		v.(*counter).report(s.fullyQualifiedName(name), s.tags, r)
+	})
 
-	s.gm.RLock()
-	for name, gauge := range s.gauges {
-		gauge.report(s.fullyQualifiedName(name), s.tags, r)
-	}
-	s.gm.RUnlock()
+	s.gauges.forEach(func(name string, v interface{}) {
+		v.(*gauge).report(s.fullyQualifiedName(name), s.tags, r)
+	})
 
-	// we do nothing for timers here because timers report directly to ths StatsReporter without buffering
+	// we do nothing for standard timers here because they report directly to
+	// the StatsReporter without buffering
 
-	s.hm.RLock()
-	for name, histogram := range s.histograms {
-		histogram.report(s.fullyQualifiedName(name), s.tags, r)
-	}
-	s.hm.RUnlock()
+	s.histograms.forEach(func(name string, v interface{}) {
+		v.(reportableHistogram).report(s.fullyQualifiedName(name), s.tags, r)
+	})
+
+	s.summaryTimers.forEach(func(name string, v interface{}) {
+		v.(*summaryTimer).report(r)
+	})
 }
 
 func (s *scope) cachedReport() {
-	s.cm.RLock()
-	for _, counter := range s.countersSlice {
-		counter.cachedReport()
-	}
-	s.cm.RUnlock()
+	s.counters.forEach(func(name string, v interface{}) {
+		v.(*counter).cachedReport()
+	})
 
-	s.gm.RLock()
-	for _, gauge := range s.gaugesSlice {
-		gauge.cachedReport()
-	}
-	s.gm.RUnlock()
+	s.gauges.forEach(func(name string, v interface{}) {
+		v.(*gauge).cachedReport()
+	})
 
-	// we do nothing for timers here because timers report directly to ths StatsReporter without buffering
+	// we do nothing for standard timers here: they report directly to the
+	// CachedTimer allocated for them in TimerWithOptions, without buffering.
 
-	s.hm.RLock()
-	for _, histogram := range s.histogramsSlice {
-		histogram.cachedReport()
-	}
-	s.hm.RUnlock()
+	s.histograms.forEach(func(name string, v interface{}) {
+		v.(reportableHistogram).cachedReport()
+	})
+
+	s.summaryTimers.forEach(func(name string, v interface{}) {
+		v.(*summaryTimer).cachedReport()
+	})
 }
 
 // reportLoop is used by the root scope for periodic reporting
@@ -298,34 +309,25 @@ func (s *scope) Counter(name string) Counter {
 		return c
 	}
 
-	s.cm.Lock()
-	defer s.cm.Unlock()
-
-	if c, ok := s.counters[name]; ok {
-		return c
-	}
-
-	var cachedCounter CachedCount
-	if s.cachedReporter != nil {
-		cachedCounter = s.cachedReporter.AllocateCounter(
-			s.fullyQualifiedName(name),
-			s.tags,
-		)
-	}
-
-	c := newCounter(cachedCounter)
-	s.counters[name] = c
-	s.countersSlice = append(s.countersSlice, c)
-
-	return c
+	v := s.counters.getOrCreate(name, func() interface{} {
+		var cachedCounter CachedCount
+		if s.cachedReporter != nil {
+			cachedCounter = s.cachedReporter.AllocateCounter(
+				s.fullyQualifiedName(name),
+				s.tags,
+			)
+		}
+		return newCounter(cachedCounter)
+	})
+	return v.(*counter)
 }
 
 func (s *scope) counter(sanitizedName string) (Counter, bool) {
-	s.cm.RLock()
-	defer s.cm.RUnlock()
-
-	c, ok := s.counters[sanitizedName]
-	return c, ok
+	v, ok := s.counters.get(sanitizedName)
+	if !ok {
+		return nil, false
+	}
+	return v.(*counter), true
 }
 
 func (s *scope) Gauge(name string) Gauge {
@@ -334,69 +336,91 @@ func (s *scope) Gauge(name string) Gauge {
 		return g
 	}
 
-	s.gm.Lock()
-	defer s.gm.Unlock()
-
-	if g, ok := s.gauges[name]; ok {
-		return g
-	}
-
-	var cachedGauge CachedGauge
-	if s.cachedReporter != nil {
-		cachedGauge = s.cachedReporter.AllocateGauge(
-			s.fullyQualifiedName(name), s.tags,
-		)
-	}
-
-	g := newGauge(cachedGauge)
-	s.gauges[name] = g
-	s.gaugesSlice = append(s.gaugesSlice, g)
-
-	return g
+	v := s.gauges.getOrCreate(name, func() interface{} {
+		var cachedGauge CachedGauge
+		if s.cachedReporter != nil {
+			cachedGauge = s.cachedReporter.AllocateGauge(
+				s.fullyQualifiedName(name), s.tags,
+			)
+		}
+		return newGauge(cachedGauge)
+	})
+	return v.(*gauge)
 }
 
 func (s *scope) gauge(name string) (Gauge, bool) {
-	s.gm.RLock()
-	defer s.gm.RUnlock()
-
-	g, ok := s.gauges[name]
-	return g, ok
+	v, ok := s.gauges.get(name)
+	if !ok {
+		return nil, false
+	}
+	return v.(*gauge), true
 }
 
 func (s *scope) Timer(name string) Timer {
+	return s.TimerWithOptions(name, nil)
+}
+
+// TimerWithOptions returns a Timer for name, configured per opts. Passing
+// nil uses the scope's ScopeOptions.DefaultTimerType with default quantiles,
+// max age and age buckets. A SummaryTimer reports through whichever of
+// ScopeOptions.Reporter/CachedReporter the scope was built with, same as any
+// other metric; configuring neither leaves it with nowhere to report and its
+// observations are simply never flushed.
+func (s *scope) TimerWithOptions(name string, opts *TimerOptions) Timer {
 	name = s.sanitizer.Name(name)
-	if t, ok := s.timer(name); ok {
-		return t
-	}
+	resolved := resolveTimerOptions(s.defaultTimerType, opts)
 
-	s.tm.Lock()
-	defer s.tm.Unlock()
+	if resolved.Type == SummaryTimer {
+		return s.summaryTimer(name, resolved)
+	}
 
-	if t, ok := s.timers[name]; ok {
+	if t, ok := s.timer(name); ok {
 		return t
 	}
 
-	var cachedTimer CachedTimer
-	if s.cachedReporter != nil {
-		cachedTimer = s.cachedReporter.AllocateTimer(
-			s.fullyQualifiedName(name), s.tags,
+	v := s.timers.getOrCreate(name, func() interface{} {
+		var cachedTimer CachedTimer
+		if br, ok := s.cachedReporter.(CachedBucketedTimerReporter); ok {
+			cachedTimer = br.AllocateBucketedTimer(
+				s.fullyQualifiedName(name), s.tags, s.defaultBuckets,
+			)
+		} else if s.cachedReporter != nil {
+			cachedTimer = s.cachedReporter.AllocateTimer(
+				s.fullyQualifiedName(name), s.tags,
+			)
+		}
+		return newTimer(
+			s.fullyQualifiedName(name), s.tags, s.reporter, cachedTimer,
 		)
-	}
+	})
+	return v.(*timer)
+}
 
-	t := newTimer(
-		s.fullyQualifiedName(name), s.tags, s.reporter, cachedTimer,
-	)
-	s.timers[name] = t
+// CachedBucketedTimerReporter is an optional extension to CachedStatsReporter,
+// feature-detected via a type assertion in scope.TimerWithOptions, for
+// reporters that represent a standard Timer as a bucketed histogram (e.g.
+// otlp.Reporter) and therefore need the scope's actual
+// ScopeOptions.DefaultBuckets to bucket it correctly - AllocateTimer's plain
+// (name, tags) signature has nowhere to carry them. Reporters that only
+// implement AllocateTimer keep compiling unchanged, falling back to whatever
+// bucket boundaries they're separately configured with.
+type CachedBucketedTimerReporter interface {
+	AllocateBucketedTimer(name string, tags map[string]string, buckets Buckets) CachedTimer
+}
 
-	return t
+func (s *scope) summaryTimer(sanitizedName string, opts TimerOptions) Timer {
+	v := s.summaryTimers.getOrCreate(sanitizedName, func() interface{} {
+		return newSummaryTimer(s.fullyQualifiedName(sanitizedName), s.tags, s.reporter, s.cachedReporter, opts)
+	})
+	return v.(*summaryTimer)
 }
 
 func (s *scope) timer(sanitizedName string) (Timer, bool) {
-	s.tm.RLock()
-	defer s.tm.RUnlock()
-
-	t, ok := s.timers[sanitizedName]
-	return t, ok
+	v, ok := s.timers.get(sanitizedName)
+	if !ok {
+		return nil, false
+	}
+	return v.(*timer), true
 }
 
 func (s *scope) Histogram(name string, b Buckets) Histogram {
@@ -409,47 +433,59 @@ func (s *scope) Histogram(name string, b Buckets) Histogram {
 		b = s.defaultBuckets
 	}
 
+	if eb, ok := b.(ExponentialBuckets); ok {
+		return s.sparseHistogramWithBuckets(name, eb)
+	}
+
 	htype := valueHistogramType
 	if _, ok := b.(DurationBuckets); ok {
 		htype = durationHistogramType
 	}
 
-	s.hm.Lock()
-	defer s.hm.Unlock()
-
-	if h, ok := s.histograms[name]; ok {
-		return h
-	}
-
-	var cachedHistogram CachedHistogram
-	if s.cachedReporter != nil {
-		cachedHistogram = s.cachedReporter.AllocateHistogram(
-			s.fullyQualifiedName(name), s.tags, b,
-		)
-	}
+	v := s.histograms.getOrCreate(name, func() interface{} {
+		var cachedHistogram CachedHistogram
+		if s.cachedReporter != nil {
+			cachedHistogram = s.cachedReporter.AllocateHistogram(
+				s.fullyQualifiedName(name), s.tags, b,
+			)
+		}
 
-	bid := getBucketsIdentity(b)
-	storage, ok := s.bucketCache[bid]
-	if !ok {
-		storage = newBucketStorage(htype, b, cachedHistogram)
-		s.bucketCache[bid] = storage
-	}
+		bid := getBucketsIdentity(b)
+		s.bucketCacheMu.Lock()
+		storage, ok := s.bucketCache[bid]
+		if !ok {
+			storage = newBucketStorage(htype, b, cachedHistogram)
+			s.bucketCache[bid] = storage
+		}
+		s.bucketCacheMu.Unlock()
 
-	h := newHistogram(
-		htype, s.fullyQualifiedName(name), s.tags, s.reporter, storage,
-	)
-	s.histograms[name] = h
-	s.histogramsSlice = append(s.histogramsSlice, h)
+		return reportableHistogram(newHistogram(
+			htype, s.fullyQualifiedName(name), s.tags, s.reporter, storage,
+		))
+	})
+	return v.(reportableHistogram)
+}
 
-	return h
+// sparseHistogramWithBuckets allocates (or returns the existing) sparse
+// histogram for name, bypassing the dense-histogram bucketCache since
+// ExponentialBuckets has no pre-declared boundaries to share.
+func (s *scope) sparseHistogramWithBuckets(name string, b ExponentialBuckets) Histogram {
+	v := s.histograms.getOrCreate(name, func() interface{} {
+		var cachedSparse CachedSparseHistogram
+		if alloc, ok := s.cachedReporter.(SparseHistogramReporter); ok {
+			cachedSparse = alloc.AllocateSparseHistogram(s.fullyQualifiedName(name), s.tags)
+		}
+		return reportableHistogram(newSparseHistogram(s.fullyQualifiedName(name), s.tags, s.reporter, cachedSparse, b))
+	})
+	return v.(reportableHistogram)
 }
 
 func (s *scope) histogram(sanitizedName string) (Histogram, bool) {
-	s.hm.RLock()
-	defer s.hm.RUnlock()
-
-	h, ok := s.histograms[sanitizedName]
-	return h, ok
+	v, ok := s.histograms.get(sanitizedName)
+	if !ok {
+		return nil, false
+	}
+	return v.(reportableHistogram), true
 }
 
 func (s *scope) Tagged(tags map[string]string) Scope {
@@ -483,8 +519,8 @@ func (s *scope) Snapshot() Snapshot {
 			tags[k] = v
 		}
 
-		ss.cm.RLock()
-		for key, c := range ss.counters {
+		ss.counters.forEach(func(key string, v interface{}) {
+			c := v.(*counter)
 			name := ss.fullyQualifiedName(key)
 			id := KeyForPrefixedStringMap(name, tags)
 			snap.counters[id] = &counterSnapshot{
@@ -492,10 +528,9 @@ func (s *scope) Snapshot() Snapshot {
 				tags:  tags,
 				value: c.snapshot(),
 			}
-		}
-		ss.cm.RUnlock()
-		ss.gm.RLock()
-		for key, g := range ss.gauges {
+		})
+		ss.gauges.forEach(func(key string, v interface{}) {
+			g := v.(*gauge)
 			name := ss.fullyQualifiedName(key)
 			id := KeyForPrefixedStringMap(name, tags)
 			snap.gauges[id] = &gaugeSnapshot{
@@ -503,10 +538,9 @@ func (s *scope) Snapshot() Snapshot {
 				tags:  tags,
 				value: g.snapshot(),
 			}
-		}
-		ss.gm.RUnlock()
-		ss.tm.RLock()
-		for key, t := range ss.timers {
+		})
+		ss.timers.forEach(func(key string, v interface{}) {
+			t := v.(*timer)
 			name := ss.fullyQualifiedName(key)
 			id := KeyForPrefixedStringMap(name, tags)
 			snap.timers[id] = &timerSnapshot{
@@ -514,43 +548,54 @@ func (s *scope) Snapshot() Snapshot {
 				tags:   tags,
 				values: t.snapshot(),
 			}
-		}
-		ss.tm.RUnlock()
-		ss.hm.RLock()
-		for key, h := range ss.histograms {
+		})
+		ss.histograms.forEach(func(key string, v interface{}) {
+			h := v.(reportableHistogram)
 			name := ss.fullyQualifiedName(key)
 			id := KeyForPrefixedStringMap(name, tags)
-			snap.histograms[id] = &histogramSnapshot{
+			hs := &histogramSnapshot{
 				name:      name,
 				tags:      tags,
 				values:    h.snapshotValues(),
 				durations: h.snapshotDurations(),
 			}
-		}
-		ss.hm.RUnlock()
+			if sh, ok := h.(*sparseHistogram); ok {
+				positive, negative := sh.BucketCounts()
+				snap.histograms[id] = &sparseHistogramSnapshot{
+					histogramSnapshot: hs,
+					schema:            sh.Schema(),
+					positive:          positive,
+					negative:          negative,
+				}
+			} else {
+				snap.histograms[id] = hs
+			}
+		})
+		ss.summaryTimers.forEach(func(key string, v interface{}) {
+			st := v.(*summaryTimer)
+			name := ss.fullyQualifiedName(key)
+			id := KeyForPrefixedStringMap(name, tags)
+			snap.summaryTimers[id] = &summaryTimerSnapshot{
+				name:      name,
+				tags:      tags,
+				quantiles: st.snapshotQuantiles(),
+			}
+		})
 	})
 
 	return snap
 }
 
+// Close closes the scope and flushes its reporter one final time. See
+// CloseWithContext to bound how long that final flush may take.
 func (s *scope) Close() error {
-	s.status.Lock()
-	defer s.status.Unlock()
-
-	// don't wait to close more than once (panic on double close of
-	// s.status.quit)
-	if s.status.closed {
-		return nil
-	}
-
-	s.status.closed = true
-	close(s.status.quit)
-	s.reportRegistryWithLock()
-
-	if closer, ok := s.baseReporter.(io.Closer); ok {
-		return closer.Close()
+	ctx := context.Background()
+	if s.closeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.closeTimeout)
+		defer cancel()
 	}
-	return nil
+	return s.CloseWithContext(ctx)
 }
 
 // NB(prateek): We assume concatenation of sanitized inputs is
@@ -601,6 +646,10 @@ type Snapshot interface {
 
 	// Histograms returns a snapshot of histogram samples since last report execution
 	Histograms() map[string]HistogramSnapshot
+
+	// SummaryTimers returns a snapshot of SummaryTimer quantile estimates
+	// since last report execution
+	SummaryTimers() map[string]SummaryTimerSnapshot
 }
 
 // CounterSnapshot is a snapshot of a counter
@@ -677,18 +726,20 @@ func mergeRightTags(tagsLeft, tagsRight map[string]string) map[string]string {
 }
 
 type snapshot struct {
-	counters   map[string]CounterSnapshot
-	gauges     map[string]GaugeSnapshot
-	timers     map[string]TimerSnapshot
-	histograms map[string]HistogramSnapshot
+	counters      map[string]CounterSnapshot
+	gauges        map[string]GaugeSnapshot
+	timers        map[string]TimerSnapshot
+	histograms    map[string]HistogramSnapshot
+	summaryTimers map[string]SummaryTimerSnapshot
 }
 
 func newSnapshot() *snapshot {
 	return &snapshot{
-		counters:   make(map[string]CounterSnapshot),
-		gauges:     make(map[string]GaugeSnapshot),
-		timers:     make(map[string]TimerSnapshot),
-		histograms: make(map[string]HistogramSnapshot),
+		counters:      make(map[string]CounterSnapshot),
+		gauges:        make(map[string]GaugeSnapshot),
+		timers:        make(map[string]TimerSnapshot),
+		histograms:    make(map[string]HistogramSnapshot),
+		summaryTimers: make(map[string]SummaryTimerSnapshot),
 	}
 }
 
@@ -708,6 +759,10 @@ func (s *snapshot) Histograms() map[string]HistogramSnapshot {
 	return s.histograms
 }
 
+func (s *snapshot) SummaryTimers() map[string]SummaryTimerSnapshot {
+	return s.summaryTimers
+}
+
 type counterSnapshot struct {
 	name  string
 	tags  map[string]string
@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tally
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// _defaultMetricShards is used when ScopeOptions.MetricShards is unset.
+const _defaultMetricShards = 16
+
+// shardedMetrics is a scope's storage for one kind of metric (counters,
+// gauges, histograms or timers), split across N independent shards so that
+// a Counter()/Gauge()/... fast-path lookup or creation on one shard doesn't
+// serialize with another shard's creator, nor with a reporter concurrently
+// draining it via forEach. Each metric is pinned to a shard by FNV-64a
+// hashing its (already-sanitized, scope-local) name.
+type shardedMetrics struct {
+	shards []*metricShard
+}
+
+type metricShard struct {
+	mu     sync.RWMutex
+	byName map[string]interface{}
+}
+
+func newShardedMetrics(n int) *shardedMetrics {
+	if n <= 0 {
+		n = _defaultMetricShards
+	}
+
+	shards := make([]*metricShard, n)
+	for i := range shards {
+		shards[i] = &metricShard{byName: make(map[string]interface{})}
+	}
+	return &shardedMetrics{shards: shards}
+}
+
+func (s *shardedMetrics) shardFor(name string) *metricShard {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return s.shards[h.Sum64()%uint64(len(s.shards))]
+}
+
+// get returns the value stored for name, if any, taking only the owning
+// shard's read lock.
+func (s *shardedMetrics) get(name string) (interface{}, bool) {
+	shard := s.shardFor(name)
+	shard.mu.RLock()
+	v, ok := shard.byName[name]
+	shard.mu.RUnlock()
+	return v, ok
+}
+
+// getOrCreate returns the existing value for name if present; otherwise it
+// calls create to build one and stores it, all while holding only the
+// owning shard's write lock.
+func (s *shardedMetrics) getOrCreate(name string, create func() interface{}) interface{} {
+	shard := s.shardFor(name)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if v, ok := shard.byName[name]; ok {
+		return v
+	}
+
+	v := create()
+	shard.byName[name] = v
+	return v
+}
+
+// count returns the total number of values stored across all shards.
+func (s *shardedMetrics) count() int {
+	total := 0
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		total += len(shard.byName)
+		shard.mu.RUnlock()
+	}
+	return total
+}
+
+// forEach visits every stored value. Iteration order is deterministic
+// across calls (shards are visited in index order, names within a shard in
+// sorted order), though not a total order across the whole scope, so that
+// sharding doesn't make test assertions that rely on iteration order flaky.
+func (s *shardedMetrics) forEach(fn func(name string, v interface{})) {
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		names := make([]string, 0, len(shard.byName))
+		for name := range shard.byName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fn(name, shard.byName[name])
+		}
+		shard.mu.RUnlock()
+	}
+}
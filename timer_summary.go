@@ -0,0 +1,307 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tally
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/beorn7/perks/quantile"
+)
+
+// TimerType selects how a scope's timers aggregate observations before
+// reporting.
+type TimerType int
+
+const (
+	// StandardTimerType reports every observation directly to the
+	// StatsReporter without buffering; this is the existing, default
+	// behavior of Timer.
+	StandardTimerType TimerType = iota
+
+	// SummaryTimer buffers observations into a rotating CKMS quantile
+	// sketch and reports only the configured quantiles, letting a
+	// backend that only understands counters/gauges still surface
+	// percentiles.
+	SummaryTimer
+)
+
+// QuantileSpec is a single quantile tracked by a SummaryTimer, paired with
+// the error tolerance CKMS is allowed around it, mirroring the
+// quantile/error pairs in statsd_exporter's summary mapping config.
+type QuantileSpec struct {
+	Quantile float64
+	Error    float64
+}
+
+// TimerOptions configures a single timer created via Scope.TimerWithOptions.
+type TimerOptions struct {
+	// Type selects the aggregation strategy; its zero value is
+	// StandardTimerType. The scope's ScopeOptions.DefaultTimerType applies
+	// only when TimerWithOptions is passed nil options.
+	Type TimerType
+
+	// Quantiles are tracked when Type is SummaryTimer. Defaults to
+	// DefaultSummaryQuantiles if empty.
+	Quantiles []QuantileSpec
+
+	// MaxAge is how long an observation contributes to the summary
+	// before its sketch is rotated out. Defaults to 10 minutes.
+	MaxAge time.Duration
+
+	// AgeBuckets is the number of sketches in the rotation; a new
+	// sketch starts accumulating every MaxAge/AgeBuckets, and the
+	// oldest is dropped. Defaults to 5.
+	AgeBuckets int
+}
+
+// DefaultSummaryQuantiles is used by a SummaryTimer when TimerOptions
+// doesn't specify Quantiles, matching common p50/p90/p99 dashboards.
+var DefaultSummaryQuantiles = []QuantileSpec{
+	{Quantile: 0.5, Error: 0.05},
+	{Quantile: 0.9, Error: 0.01},
+	{Quantile: 0.99, Error: 0.001},
+}
+
+const (
+	_defaultMaxAge     = 10 * time.Minute
+	_defaultAgeBuckets = 5
+)
+
+func resolveTimerOptions(scopeDefault TimerType, opts *TimerOptions) TimerOptions {
+	var resolved TimerOptions
+	if opts != nil {
+		resolved = *opts
+	} else {
+		resolved.Type = scopeDefault
+	}
+
+	if len(resolved.Quantiles) == 0 {
+		resolved.Quantiles = DefaultSummaryQuantiles
+	}
+	if resolved.MaxAge <= 0 {
+		resolved.MaxAge = _defaultMaxAge
+	}
+	if resolved.AgeBuckets <= 0 {
+		resolved.AgeBuckets = _defaultAgeBuckets
+	}
+
+	return resolved
+}
+
+// summaryTimer is a Timer that buffers observations into a rotating ring
+// of CKMS quantile sketches, reporting from the ring's representative
+// sketch (see representativeLocked).
+type summaryTimer struct {
+	mu sync.Mutex
+
+	name           string
+	tags           map[string]string
+	reporter       StatsReporter
+	cachedReporter CachedStatsReporter
+	cachedGauges   map[float64]CachedGauge
+
+	targets     map[float64]float64
+	rotateEvery time.Duration
+	ring        []*quantile.Stream
+	head        int
+	lastRotate  time.Time
+}
+
+func newSummaryTimer(
+	name string,
+	tags map[string]string,
+	r StatsReporter,
+	cr CachedStatsReporter,
+	opts TimerOptions,
+) *summaryTimer {
+	targets := make(map[float64]float64, len(opts.Quantiles))
+	for _, q := range opts.Quantiles {
+		targets[q.Quantile] = q.Error
+	}
+
+	ring := make([]*quantile.Stream, opts.AgeBuckets)
+	for i := range ring {
+		ring[i] = quantile.NewTargeted(targets)
+	}
+
+	return &summaryTimer{
+		name:           name,
+		tags:           tags,
+		reporter:       r,
+		cachedReporter: cr,
+		targets:        targets,
+		rotateEvery:    opts.MaxAge / time.Duration(opts.AgeBuckets),
+		ring:           ring,
+		lastRotate:     globalNow(),
+	}
+}
+
+// Record implements Timer.
+func (t *summaryTimer) Record(value time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotateLocked()
+	for _, s := range t.ring {
+		s.Insert(value.Seconds())
+	}
+}
+
+// Start implements Timer, recording the elapsed duration when the returned
+// Stopwatch is stopped.
+func (t *summaryTimer) Start() Stopwatch {
+	return NewStopwatch(globalNow(), t)
+}
+
+// RecordStopwatch implements StopwatchRecorder.
+func (t *summaryTimer) RecordStopwatch(stopwatchStart time.Time) {
+	t.Record(globalNow().Sub(stopwatchStart))
+}
+
+// rotateLocked advances the ring by however many rotateEvery periods have
+// elapsed since the last rotation, resetting the oldest sketch(es) in turn
+// so it starts accumulating fresh observations.
+func (t *summaryTimer) rotateLocked() {
+	now := globalNow()
+	for now.Sub(t.lastRotate) >= t.rotateEvery {
+		t.head = (t.head + 1) % len(t.ring)
+		t.ring[t.head].Reset()
+		t.lastRotate = t.lastRotate.Add(t.rotateEvery)
+	}
+}
+
+// representativeLocked rotates the ring and returns the single sketch whose
+// accumulated samples best approximate the full MaxAge window: the one
+// about to be reset next. Record inserts every observation into every live
+// sketch, so a sketch's age is how long ago it was last reset, and the one
+// due to be reset next is the one that's been accumulating the longest -
+// anywhere from just under one rotateEvery to just under the full MaxAge,
+// depending how long the ring has been running. Merging every sketch
+// together instead would count the most recent rotateEvery slice of
+// history once per still-live sketch while the oldest slice is only
+// counted once, skewing the estimate toward recent observations. Callers
+// must hold t.mu.
+func (t *summaryTimer) representativeLocked() *quantile.Stream {
+	t.rotateLocked()
+	return t.ring[(t.head+1)%len(t.ring)]
+}
+
+func (t *summaryTimer) quantileTags(q float64) map[string]string {
+	tags := make(map[string]string, len(t.tags)+1)
+	for k, v := range t.tags {
+		tags[k] = v
+	}
+	tags["quantile"] = fmt.Sprintf("%v", q)
+	return tags
+}
+
+// report queries the ring's representative sketch and emits each configured
+// quantile as its own gauge-like sample, tagged with "quantile".
+func (t *summaryTimer) report(r StatsReporter) {
+	t.mu.Lock()
+	rep := t.representativeLocked()
+	values := make(map[float64]float64, len(t.targets))
+	for q := range t.targets {
+		values[q] = rep.Query(q)
+	}
+	t.mu.Unlock()
+
+	for q, v := range values {
+		r.ReportGauge(t.name, t.quantileTags(q), v)
+	}
+}
+
+// cachedReport is the cached-reporter counterpart to report, letting a
+// SummaryTimer be used on a scope configured with a CachedStatsReporter
+// instead of a StatsReporter: each quantile gets its own
+// lazily-allocated CachedGauge, tagged with "quantile" exactly like report's
+// push-mode gauges, and is re-used across reports.
+func (t *summaryTimer) cachedReport() {
+	if t.cachedReporter == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rep := t.representativeLocked()
+	if t.cachedGauges == nil {
+		t.cachedGauges = make(map[float64]CachedGauge, len(t.targets))
+	}
+
+	for q := range t.targets {
+		g, ok := t.cachedGauges[q]
+		if !ok {
+			g = t.cachedReporter.AllocateGauge(t.name, t.quantileTags(q))
+			t.cachedGauges[q] = g
+		}
+		g.ReportGauge(rep.Query(q))
+	}
+}
+
+// snapshotQuantiles queries the ring's representative sketch and returns the
+// current estimate for each configured quantile, for Scope.Snapshot.
+func (t *summaryTimer) snapshotQuantiles() map[float64]time.Duration {
+	t.mu.Lock()
+	rep := t.representativeLocked()
+	quantiles := make(map[float64]time.Duration, len(t.targets))
+	for q := range t.targets {
+		quantiles[q] = time.Duration(rep.Query(q) * float64(time.Second))
+	}
+	t.mu.Unlock()
+
+	return quantiles
+}
+
+// SummaryTimerSnapshot is a snapshot of a SummaryTimer. Unlike TimerSnapshot,
+// it surfaces the timer's currently estimated quantiles rather than raw
+// observations, since a SummaryTimer doesn't retain those.
+type SummaryTimerSnapshot interface {
+	// Name returns the name
+	Name() string
+
+	// Tags returns the tags
+	Tags() map[string]string
+
+	// Quantiles returns the currently estimated value at each configured
+	// quantile.
+	Quantiles() map[float64]time.Duration
+}
+
+type summaryTimerSnapshot struct {
+	name      string
+	tags      map[string]string
+	quantiles map[float64]time.Duration
+}
+
+func (s *summaryTimerSnapshot) Name() string {
+	return s.name
+}
+
+func (s *summaryTimerSnapshot) Tags() map[string]string {
+	return s.tags
+}
+
+func (s *summaryTimerSnapshot) Quantiles() map[float64]time.Duration {
+	return s.quantiles
+}
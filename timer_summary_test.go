@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tally
+
+import (
+	"testing"
+	"time"
+)
+
+// stubStatsReporter is a minimal StatsReporter that only records the gauges
+// reported to it, for asserting on summaryTimer.report's output.
+type stubStatsReporter struct {
+	onGauge func(name string, tags map[string]string, value float64)
+}
+
+func (s *stubStatsReporter) ReportCounter(name string, tags map[string]string, value int64) {}
+func (s *stubStatsReporter) ReportGauge(name string, tags map[string]string, value float64) {
+	if s.onGauge != nil {
+		s.onGauge(name, tags, value)
+	}
+}
+func (s *stubStatsReporter) ReportTimer(name string, tags map[string]string, interval time.Duration) {
+}
+func (s *stubStatsReporter) ReportHistogramValueSamples(
+	name string,
+	tags map[string]string,
+	buckets Buckets,
+	bucketLowerBound, bucketUpperBound float64,
+	samples int64,
+) {
+}
+func (s *stubStatsReporter) ReportHistogramDurationSamples(
+	name string,
+	tags map[string]string,
+	buckets Buckets,
+	bucketLowerBound, bucketUpperBound time.Duration,
+	samples int64,
+) {
+}
+func (s *stubStatsReporter) Capabilities() Capabilities { return capabilitiesNone }
+func (s *stubStatsReporter) Flush()                     {}
+
+// withFrozenGlobalNow overrides globalNow for the duration of a test,
+// returning a setter to advance the fake clock and a restore func.
+func withFrozenGlobalNow(t *testing.T, start time.Time) func(time.Time) {
+	t.Helper()
+	restore := globalNow
+	now := start
+	globalNow = func() time.Time { return now }
+	t.Cleanup(func() { globalNow = restore })
+	return func(next time.Time) { now = next }
+}
+
+// TestSummaryTimerRepresentativeAvoidsMergeBias exercises the bug the ring
+// previously had: reporting by merging every live sketch double-counts
+// observations made while more than one sketch is still live, since Record
+// inserts into all of them. The representative sketch - the one about to be
+// reset next - should instead see each observation exactly once.
+func TestSummaryTimerRepresentativeAvoidsMergeBias(t *testing.T) {
+	start := time.Unix(0, 0)
+	setNow := withFrozenGlobalNow(t, start)
+
+	st := newSummaryTimer("request.latency", nil, nil, nil, TimerOptions{
+		Quantiles:  []QuantileSpec{{Quantile: 0.5, Error: 0}},
+		MaxAge:     2 * time.Second,
+		AgeBuckets: 2,
+	})
+
+	st.Record(100 * time.Millisecond)
+
+	setNow(start.Add(time.Second))
+	st.Record(200 * time.Millisecond)
+
+	st.mu.Lock()
+	rep := st.representativeLocked()
+	samples := rep.Samples()
+	st.mu.Unlock()
+
+	if got := len(samples); got != 2 {
+		t.Fatalf("representative sketch holds %d samples, want 2 (one per Record call); "+
+			"merging the whole ring instead would double-count the second observation "+
+			"since it was inserted into both still-live sketches", got)
+	}
+}
+
+// TestSummaryTimerRotationAdvancesHead verifies that the ring's head only
+// moves forward once a full rotateEvery period has elapsed, and that it
+// wraps around the ring.
+func TestSummaryTimerRotationAdvancesHead(t *testing.T) {
+	start := time.Unix(0, 0)
+	setNow := withFrozenGlobalNow(t, start)
+
+	st := newSummaryTimer("request.latency", nil, nil, nil, TimerOptions{
+		Quantiles:  DefaultSummaryQuantiles,
+		MaxAge:     3 * time.Second,
+		AgeBuckets: 3,
+	})
+
+	st.mu.Lock()
+	st.rotateLocked()
+	head := st.head
+	st.mu.Unlock()
+
+	if head != 0 {
+		t.Fatalf("head advanced to %d before any time elapsed, want 0", head)
+	}
+
+	setNow(start.Add(time.Second))
+	st.mu.Lock()
+	st.rotateLocked()
+	head = st.head
+	st.mu.Unlock()
+
+	if head != 1 {
+		t.Fatalf("head = %d after one rotateEvery elapsed, want 1", head)
+	}
+
+	setNow(start.Add(3 * time.Second))
+	st.mu.Lock()
+	st.rotateLocked()
+	head = st.head
+	st.mu.Unlock()
+
+	if head != 0 {
+		t.Fatalf("head = %d after wrapping past the ring length, want 0", head)
+	}
+}
+
+// TestSummaryTimerReportEmitsEveryQuantile checks report's plumbing end to
+// end: every configured quantile is reported exactly once, tagged with its
+// own "quantile" value.
+func TestSummaryTimerReportEmitsEveryQuantile(t *testing.T) {
+	st := newSummaryTimer("request.latency", map[string]string{"region": "us"}, nil, nil, TimerOptions{
+		Quantiles:  DefaultSummaryQuantiles,
+		MaxAge:     time.Minute,
+		AgeBuckets: 5,
+	})
+
+	for i := 1; i <= 10; i++ {
+		st.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	seen := make(map[string]bool)
+	st.report(&stubStatsReporter{
+		onGauge: func(name string, tags map[string]string, value float64) {
+			if tags["region"] != "us" {
+				t.Errorf("gauge for quantile %s missing region tag: %v", tags["quantile"], tags)
+			}
+			seen[tags["quantile"]] = true
+		},
+	})
+
+	if got := len(seen); got != len(DefaultSummaryQuantiles) {
+		t.Fatalf("report emitted %d distinct quantile gauges, want %d", got, len(DefaultSummaryQuantiles))
+	}
+}